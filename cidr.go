@@ -0,0 +1,94 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tcpproxy
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+)
+
+// cidrMatcher matches connections whose client (remote) IP address
+// falls within one of nets. It never looks at the connection's
+// bytes, so it can run ahead of the byte-sniffing matchers used by
+// HTTP Host and TLS SNI routing.
+type cidrMatcher struct {
+	nets []*net.IPNet
+}
+
+func (m *cidrMatcher) match(_ *bufio.Reader, c net.Conn) bool {
+	host, _, err := net.SplitHostPort(c.RemoteAddr().String())
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, n := range m.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, fmt.Errorf("tcpproxy: invalid CIDR %q: %w", c, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// AddRouteByClientCIDR appends a route to the ipPort listener that
+// matches connections whose client IP address falls within one of
+// cidrs, directing matching connections to dest. It returns an error
+// if any entry of cidrs is not a valid CIDR block, per net.ParseCIDR,
+// in which case no route is added.
+//
+// Matching is purely address-based and never reads from the
+// connection. Like every route, it is tried in the order it was
+// added, so it composes with AddHTTPHostRoute, AddSNIHostRoute, and
+// AddRoute: put the most specific CIDR routes first, ahead of any
+// byte-sniffing routes, and a plain AddRoute last as the fallback. This lets
+// multiple client tiers (e.g. an admin CIDR vs. the public internet)
+// share a single listening port without fronting tcpproxy with
+// iptables.
+func (p *Proxy) AddRouteByClientCIDR(ipPort string, cidrs []string, dest Target) error {
+	nets, err := parseCIDRs(cidrs)
+	if err != nil {
+		return err
+	}
+	p.addRoute(ipPort, &cidrMatcher{nets: nets}, dest)
+	return nil
+}
+
+// AddDenyCIDR appends a route to the ipPort listener that matches
+// connections whose client IP address falls within one of cidrs and
+// closes them immediately, without being proxied anywhere. It returns
+// an error if any entry of cidrs is not a valid CIDR block, per
+// net.ParseCIDR, in which case no route is added.
+//
+// As with all routes, order matters: add AddDenyCIDR calls before
+// the routes they're meant to override, since the first matching
+// route on an ipPort wins.
+func (p *Proxy) AddDenyCIDR(ipPort string, cidrs []string) error {
+	nets, err := parseCIDRs(cidrs)
+	if err != nil {
+		return err
+	}
+	p.addRoute(ipPort, &cidrMatcher{nets: nets}, denyTarget{})
+	return nil
+}
+
+// denyTarget is a Target that closes every connection it's handed.
+type denyTarget struct{}
+
+func (denyTarget) HandleConn(c net.Conn, _ net.Conn) { c.Close() }
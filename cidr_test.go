@@ -0,0 +1,107 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tcpproxy
+
+import (
+	"net"
+	"testing"
+)
+
+func TestCIDRMatcherMatch(t *testing.T) {
+	nets, err := parseCIDRs([]string{"192.0.2.0/24", "2001:db8::/32"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &cidrMatcher{nets: nets}
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"192.0.2.1:1234", true},
+		{"192.0.2.255:1234", true},
+		{"198.51.100.1:1234", false},
+		{"[2001:db8::1]:1234", true},
+		{"[2001:db9::1]:1234", false},
+	}
+	for _, tt := range tests {
+		c := &fakeAddrConn{remoteAddr: tt.addr}
+		if got := m.match(nil, c); got != tt.want {
+			t.Errorf("match(%q) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestAddRouteByClientCIDRInvalid(t *testing.T) {
+	var p Proxy
+	if err := p.AddRouteByClientCIDR(":0", []string{"not-a-cidr"}, To("127.0.0.1:1")); err == nil {
+		t.Error("AddRouteByClientCIDR with invalid CIDR = nil error, want error")
+	}
+}
+
+func TestAddDenyCIDRInvalid(t *testing.T) {
+	var p Proxy
+	if err := p.AddDenyCIDR(":0", []string{"not-a-cidr"}); err == nil {
+		t.Error("AddDenyCIDR with invalid CIDR = nil error, want error")
+	}
+}
+
+// TestAddDenyCIDR verifies that a connection from a denied CIDR is
+// closed, with the deny route added ahead of a fallback route.
+func TestAddDenyCIDR(t *testing.T) {
+	backendLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backendLn.Close()
+	go func() {
+		c, err := backendLn.Accept()
+		if err != nil {
+			return
+		}
+		c.Close()
+	}()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	var p Proxy
+	p.ListenFunc = func(string, string) (net.Listener, error) { return ln, nil }
+	if err := p.AddDenyCIDR(ln.Addr().String(), []string{"127.0.0.1/32"}); err != nil {
+		t.Fatal(err)
+	}
+	p.AddRoute(ln.Addr().String(), To(backendLn.Addr().String()))
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	buf := make([]byte, 1)
+	if _, err := conn.Read(buf); err == nil {
+		t.Error("read from denied conn succeeded, want it closed")
+	}
+}
+
+// fakeAddrConn is a net.Conn whose RemoteAddr is a fixed string,
+// useful for exercising matchers without a real connection.
+type fakeAddrConn struct {
+	net.Conn
+	remoteAddr string
+}
+
+func (c *fakeAddrConn) RemoteAddr() net.Addr {
+	return fakeAddr(c.remoteAddr)
+}
+
+type fakeAddr string
+
+func (a fakeAddr) Network() string { return "tcp" }
+func (a fakeAddr) String() string  { return string(a) }
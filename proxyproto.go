@@ -0,0 +1,289 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tcpproxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ProxyProtoVersion selects which version, if any, of the HAProxy
+// PROXY protocol is written to upstream connections made by a
+// DialProxy, so that the backend can learn the original client's
+// address instead of seeing the proxy's.
+//
+// See http://www.haproxy.org/download/1.8/doc/proxy-protocol.txt.
+type ProxyProtoVersion int
+
+const (
+	// ProxyProtoOff sends no PROXY protocol header. It is the
+	// zero value, so DialProxy's default behavior is unchanged.
+	ProxyProtoOff ProxyProtoVersion = iota
+
+	// ProxyProtoV1 sends a human-readable PROXY protocol v1 header.
+	ProxyProtoV1
+
+	// ProxyProtoV2 sends a binary PROXY protocol v2 header.
+	ProxyProtoV2
+)
+
+var proxyProtoV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// writeProxyHeader writes a PROXY protocol header of the given
+// version to w, describing a TCP connection from src to dst. It
+// returns an error if version is not a recognized version, or if
+// src and dst are not both *net.TCPAddr.
+func writeProxyHeader(w io.Writer, version ProxyProtoVersion, src, dst net.Addr) error {
+	srcTCP, ok := src.(*net.TCPAddr)
+	if !ok {
+		return fmt.Errorf("tcpproxy: PROXY protocol requires a TCP source address, got %T", src)
+	}
+	dstTCP, ok := dst.(*net.TCPAddr)
+	if !ok {
+		return fmt.Errorf("tcpproxy: PROXY protocol requires a TCP destination address, got %T", dst)
+	}
+	switch version {
+	case ProxyProtoV1:
+		return writeProxyHeaderV1(w, srcTCP, dstTCP)
+	case ProxyProtoV2:
+		return writeProxyHeaderV2(w, srcTCP, dstTCP)
+	default:
+		return fmt.Errorf("tcpproxy: unknown ProxyProtoVersion %d", version)
+	}
+}
+
+func writeProxyHeaderV1(w io.Writer, src, dst *net.TCPAddr) error {
+	proto := "TCP4"
+	if src.IP.To4() == nil || dst.IP.To4() == nil {
+		proto = "TCP6"
+		if src.IP.To4() != nil || dst.IP.To4() != nil {
+			return fmt.Errorf("tcpproxy: PROXY protocol v1 requires src and dst to be the same IP family, got %v and %v", src.IP, dst.IP)
+		}
+	}
+	_, err := fmt.Fprintf(w, "PROXY %s %s %s %d %d\r\n", proto, src.IP.String(), dst.IP.String(), src.Port, dst.Port)
+	return err
+}
+
+func writeProxyHeaderV2(w io.Writer, src, dst *net.TCPAddr) error {
+	var famProto byte = 0x11 // TCP over IPv4
+	srcIP, dstIP := src.IP.To4(), dst.IP.To4()
+	if srcIP == nil || dstIP == nil {
+		famProto = 0x21 // TCP over IPv6
+		srcIP, dstIP = src.IP.To16(), dst.IP.To16()
+	}
+	if srcIP == nil || dstIP == nil {
+		return errors.New("tcpproxy: PROXY protocol v2 requires valid IPv4 or IPv6 addresses")
+	}
+	buf := make([]byte, 0, len(proxyProtoV2Sig)+4+len(srcIP)*2+4)
+	buf = append(buf, proxyProtoV2Sig...)
+	buf = append(buf, 0x21, famProto) // version 2, command PROXY
+	addrLen := len(srcIP)*2 + 4
+	buf = append(buf, byte(addrLen>>8), byte(addrLen))
+	buf = append(buf, srcIP...)
+	buf = append(buf, dstIP...)
+	buf = append(buf, byte(src.Port>>8), byte(src.Port), byte(dst.Port>>8), byte(dst.Port))
+	_, err := w.Write(buf)
+	return err
+}
+
+// proxyProtoHeaderTimeout bounds how long a single connection may
+// take to present its PROXY protocol header. Parsing happens lazily
+// (see proxyProtoConn.parse), on whatever goroutine first reads from
+// or asks the RemoteAddr of the connection, so this timeout only
+// ever blocks that one connection, never a shared Accept loop.
+var proxyProtoHeaderTimeout = 10 * time.Second
+
+// proxyProtoConn overrides RemoteAddr with the address decoded from
+// an inbound PROXY protocol header, while reading the rest of the
+// stream from r (which replays any bytes consumed while parsing the
+// header, followed by the remainder of the underlying conn).
+//
+// For conns from NewProxyProtocolListener, the header isn't parsed
+// until the first Read or RemoteAddr call, rather than up front: that keeps a connection that sends a
+// malformed header, or none at all, from blocking anyone but the
+// caller that ends up using it.
+type proxyProtoConn struct {
+	net.Conn
+
+	once       sync.Once
+	r          io.Reader
+	remoteAddr net.Addr
+	parseErr   error
+}
+
+func (c *proxyProtoConn) parse() {
+	c.once.Do(func() {
+		if err := c.Conn.SetReadDeadline(time.Now().Add(proxyProtoHeaderTimeout)); err == nil {
+			defer c.Conn.SetReadDeadline(time.Time{})
+		}
+		br := bufio.NewReader(c.Conn)
+		addr, err := parseProxyHeader(br)
+		if err != nil {
+			c.parseErr = err
+			return
+		}
+		buffered, _ := br.Peek(br.Buffered())
+		c.r = io.MultiReader(bytes.NewReader(buffered), c.Conn)
+		c.remoteAddr = addr
+	})
+}
+
+func (c *proxyProtoConn) Read(p []byte) (int, error) {
+	c.parse()
+	if c.parseErr != nil {
+		return 0, c.parseErr
+	}
+	return c.r.Read(p)
+}
+
+func (c *proxyProtoConn) RemoteAddr() net.Addr {
+	c.parse()
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// WrapProxyProtocol reads a PROXY protocol v1 or v2 header from the
+// front of c and returns a net.Conn whose RemoteAddr reports the
+// original client address carried in that header. The rest of c's
+// bytes are left untouched for the caller to read.
+//
+// If the header declares an unknown/health-check source (PROXY
+// protocol's "UNKNOWN" proto, or v2's LOCAL command), the returned
+// conn reports c's original RemoteAddr.
+//
+// WrapProxyProtocol is meant to be used on freshly Accepted
+// connections, typically from a net.Listener wrapped with
+// NewProxyProtocolListener, so that Targets see the real client
+// address when tcpproxy itself sits behind something like HAProxy,
+// an AWS NLB, or Envoy.
+func WrapProxyProtocol(c net.Conn) (net.Conn, error) {
+	br := bufio.NewReader(c)
+	addr, err := parseProxyHeader(br)
+	if err != nil {
+		return nil, err
+	}
+	buffered, _ := br.Peek(br.Buffered())
+	pc := &proxyProtoConn{
+		Conn:       c,
+		r:          io.MultiReader(bytes.NewReader(buffered), c),
+		remoteAddr: addr,
+	}
+	// The header has already been consumed above, so Read and
+	// RemoteAddr must not parse the stream again.
+	pc.once.Do(func() {})
+	return pc, nil
+}
+
+func parseProxyHeader(br *bufio.Reader) (net.Addr, error) {
+	peek, err := br.Peek(len(proxyProtoV2Sig))
+	if err == nil && bytes.Equal(peek, proxyProtoV2Sig) {
+		return parseProxyHeaderV2(br)
+	}
+	return parseProxyHeaderV1(br)
+}
+
+func parseProxyHeaderV1(br *bufio.Reader) (net.Addr, error) {
+	line, err := br.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("tcpproxy: reading PROXY v1 header: %w", err)
+	}
+	line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+	fields := strings.Fields(line)
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, fmt.Errorf("tcpproxy: malformed PROXY v1 header %q", line)
+	}
+	if fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 {
+		return nil, fmt.Errorf("tcpproxy: malformed PROXY v1 header %q", line)
+	}
+	ip := net.ParseIP(fields[2])
+	if ip == nil {
+		return nil, fmt.Errorf("tcpproxy: invalid PROXY v1 source address %q", fields[2])
+	}
+	port, err := strconv.Atoi(fields[4])
+	if err != nil {
+		return nil, fmt.Errorf("tcpproxy: invalid PROXY v1 source port %q", fields[4])
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+func parseProxyHeaderV2(br *bufio.Reader) (net.Addr, error) {
+	head := make([]byte, len(proxyProtoV2Sig)+4)
+	if _, err := io.ReadFull(br, head); err != nil {
+		return nil, fmt.Errorf("tcpproxy: reading PROXY v2 header: %w", err)
+	}
+	verCmd := head[len(proxyProtoV2Sig)]
+	famProto := head[len(proxyProtoV2Sig)+1]
+	addrLen := int(binary.BigEndian.Uint16(head[len(proxyProtoV2Sig)+2:]))
+	addr := make([]byte, addrLen)
+	if _, err := io.ReadFull(br, addr); err != nil {
+		return nil, fmt.Errorf("tcpproxy: reading PROXY v2 address block: %w", err)
+	}
+	if verCmd>>4 != 0x2 {
+		return nil, fmt.Errorf("tcpproxy: unsupported PROXY protocol version %#x", verCmd>>4)
+	}
+	if verCmd&0x0f == 0x0 {
+		// LOCAL command: health check / no proxied connection.
+		return nil, nil
+	}
+	switch famProto {
+	case 0x11: // TCP over IPv4
+		if len(addr) < 12 {
+			return nil, errors.New("tcpproxy: truncated PROXY v2 IPv4 address block")
+		}
+		port := binary.BigEndian.Uint16(addr[8:10])
+		return &net.TCPAddr{IP: net.IP(addr[0:4]), Port: int(port)}, nil
+	case 0x21: // TCP over IPv6
+		if len(addr) < 36 {
+			return nil, errors.New("tcpproxy: truncated PROXY v2 IPv6 address block")
+		}
+		port := binary.BigEndian.Uint16(addr[32:34])
+		return &net.TCPAddr{IP: net.IP(addr[0:16]), Port: int(port)}, nil
+	default:
+		return nil, fmt.Errorf("tcpproxy: unsupported PROXY v2 family/protocol %#x", famProto)
+	}
+}
+
+// NewProxyProtocolListener wraps ln so that every Accepted
+// connection has its PROXY protocol header (if any) consumed before
+// being handed to the caller. It can be returned from a Proxy's
+// ListenFunc to make AddRoute (and friends) see the original client
+// address when tcpproxy is deployed behind a PROXY-protocol-speaking
+// load balancer.
+//
+// Unlike WrapProxyProtocol, Accept never parses the header itself:
+// a malformed header, or a client that sends nothing at all, would
+// otherwise wedge the whole listener (Accept is called from a single
+// loop) instead of just the one bad connection. Parsing is deferred
+// to whichever goroutine first reads from or asks the RemoteAddr of
+// the returned conn, bounded by proxyProtoHeaderTimeout.
+func NewProxyProtocolListener(ln net.Listener) net.Listener {
+	return &proxyProtoListener{ln}
+}
+
+type proxyProtoListener struct {
+	net.Listener
+}
+
+func (l *proxyProtoListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyProtoConn{Conn: c}, nil
+}
@@ -0,0 +1,144 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tcpproxy
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestWriteProxyHeaderV1RoundTrip(t *testing.T) {
+	tests := []struct {
+		name     string
+		src, dst *net.TCPAddr
+	}{
+		{"ipv4", &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1111}, &net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 2222}},
+		{"ipv6", &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1111}, &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 2222}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := writeProxyHeaderV1(&buf, tt.src, tt.dst); err != nil {
+				t.Fatalf("writeProxyHeaderV1: %v", err)
+			}
+			got, err := parseProxyHeaderV1(bufio.NewReader(&buf))
+			if err != nil {
+				t.Fatalf("parseProxyHeaderV1: %v", err)
+			}
+			want := &net.TCPAddr{IP: tt.src.IP, Port: tt.src.Port}
+			if got.String() != want.String() {
+				t.Errorf("got %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestWriteProxyHeaderV1FamilyMismatch(t *testing.T) {
+	src := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1111}
+	dst := &net.TCPAddr{IP: net.ParseIP("::1"), Port: 2222}
+	var buf bytes.Buffer
+	if err := writeProxyHeaderV1(&buf, src, dst); err == nil {
+		t.Fatalf("writeProxyHeaderV1 with mismatched families = %q, want error", buf.String())
+	}
+}
+
+func TestWriteProxyHeaderV2RoundTrip(t *testing.T) {
+	tests := []struct {
+		name     string
+		src, dst *net.TCPAddr
+	}{
+		{"ipv4", &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1111}, &net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 2222}},
+		{"ipv6", &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1111}, &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 2222}},
+		{"mixed", &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1111}, &net.TCPAddr{IP: net.ParseIP("::1"), Port: 2222}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := writeProxyHeaderV2(&buf, tt.src, tt.dst); err != nil {
+				t.Fatalf("writeProxyHeaderV2: %v", err)
+			}
+			got, err := parseProxyHeaderV2(bufio.NewReader(&buf))
+			if err != nil {
+				t.Fatalf("parseProxyHeaderV2: %v", err)
+			}
+			want := &net.TCPAddr{IP: tt.src.IP, Port: tt.src.Port}
+			if got.String() != want.String() {
+				t.Errorf("got %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestParseProxyHeaderV1Malformed(t *testing.T) {
+	tests := []string{
+		"",
+		"GARBAGE\r\n",
+		"PROXY TCP4 1.2.3.4\r\n",
+		"PROXY TCP4 not-an-ip 5.6.7.8 1111 2222\r\n",
+		"PROXY TCP4 1.2.3.4 5.6.7.8 not-a-port 2222\r\n",
+	}
+	for _, tt := range tests {
+		_, err := parseProxyHeaderV1(bufio.NewReader(bytes.NewReader([]byte(tt))))
+		if err == nil {
+			t.Errorf("parseProxyHeaderV1(%q) = nil error, want error", tt)
+		}
+	}
+}
+
+func TestParseProxyHeaderV1Unknown(t *testing.T) {
+	addr, err := parseProxyHeaderV1(bufio.NewReader(bytes.NewReader([]byte("PROXY UNKNOWN\r\n"))))
+	if err != nil {
+		t.Fatalf("parseProxyHeaderV1: %v", err)
+	}
+	if addr != nil {
+		t.Errorf("got addr %v, want nil for UNKNOWN", addr)
+	}
+}
+
+func TestProxyProtoConnLazyParse(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	pc := &proxyProtoConn{Conn: server}
+
+	writeErrc := make(chan error, 1)
+	go func() {
+		_, err := client.Write([]byte("PROXY TCP4 192.0.2.1 192.0.2.2 1111 2222\r\nhello"))
+		writeErrc <- err
+	}()
+
+	buf := make([]byte, 5)
+	n, err := pc.Read(buf)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if string(buf[:n]) != "hello" {
+		t.Errorf("got %q, want %q", buf[:n], "hello")
+	}
+	if got, want := pc.RemoteAddr().String(), "192.0.2.1:1111"; got != want {
+		t.Errorf("RemoteAddr() = %q, want %q", got, want)
+	}
+	if err := <-writeErrc; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestProxyProtoConnTimeout(t *testing.T) {
+	orig := proxyProtoHeaderTimeout
+	proxyProtoHeaderTimeout = 50 * time.Millisecond
+	defer func() { proxyProtoHeaderTimeout = orig }()
+
+	server, client := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	pc := &proxyProtoConn{Conn: server}
+
+	_, err := pc.Read(make([]byte, 1))
+	if err == nil {
+		t.Fatal("Read succeeded, want timeout error from an unresponsive client")
+	}
+}
@@ -0,0 +1,348 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tcpproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"time"
+)
+
+// ToSOCKS5 returns a Target that proxies matched connections to addr
+// by dialing through the SOCKS5 proxy listening at proxyAddr.
+func ToSOCKS5(proxyAddr, addr string) Target {
+	return &SOCKS5DialProxy{ProxyAddr: proxyAddr, Addr: addr}
+}
+
+// SOCKS5DialProxy implements Target by dialing the configured SOCKS5
+// proxy, asking it to CONNECT to Addr, and then proxying data back
+// and forth over the resulting tunnel.
+//
+// The ToSOCKS5 func is a shorthand way of creating a SOCKS5DialProxy.
+type SOCKS5DialProxy struct {
+	// ProxyAddr is the TCP address of the SOCKS5 proxy to dial,
+	// e.g. "127.0.0.1:9050" for a local Tor instance.
+	ProxyAddr string
+
+	// Addr is the address, in host:port form, that the SOCKS5
+	// proxy should connect to on our behalf. The host may be a
+	// hostname, an IPv4 address, or an IPv6 address.
+	Addr string
+
+	// Username and Password, if Username is non-empty, are sent
+	// to the proxy for username/password subnegotiation, as
+	// described in RFC 1929. If Username is empty, no
+	// authentication is attempted and only the "no
+	// authentication required" method is offered.
+	Username string
+	Password string
+
+	// KeepAlivePeriod sets the period between TCP keep alives.
+	// If zero, a default is used. To disable, use a negative number.
+	KeepAlivePeriod time.Duration
+
+	// DialTimeout optionally specifies a dial timeout for
+	// connecting to ProxyAddr.
+	// If zero, a default is used.
+	// If negative, the timeout is disabled.
+	DialTimeout time.Duration
+
+	// DialContext optionally specifies an alternate dial function
+	// for reaching ProxyAddr. If nil, the standard
+	// net.Dialer.DialContext method is used.
+	DialContext func(ctx context.Context, network, address string) (net.Conn, error)
+
+	// OnDialError optionally specifies an alternate way to handle
+	// errors dialing ProxyAddr or completing the SOCKS5 handshake.
+	// If nil, the error is logged and src is closed.
+	// If non-nil, src is not closed automatically.
+	OnDialError func(src net.Conn, dstDialErr error)
+
+	// ShutdownGracePeriod is how long a connection is given to
+	// finish up on its own once its Proxy's Shutdown deadline
+	// expires, before HandleConn forces it closed. If zero, a
+	// default is used.
+	ShutdownGracePeriod time.Duration
+
+	// hooks is set by addRoute to the owning Proxy's Hooks. It's
+	// nil when used directly as a Target without going through a
+	// Proxy.
+	hooks *Hooks
+
+	// shutdownc is set by addRoute to the owning Proxy's shutdown
+	// channel. It's nil when used directly as a Target without
+	// going through a Proxy.
+	shutdownc <-chan struct{}
+}
+
+func (sp *SOCKS5DialProxy) setHooks(h *Hooks)              { sp.hooks = h }
+func (sp *SOCKS5DialProxy) setShutdownC(c <-chan struct{}) { sp.shutdownc = c }
+
+func (sp *SOCKS5DialProxy) shutdownGracePeriod() time.Duration {
+	if sp.ShutdownGracePeriod > 0 {
+		return sp.ShutdownGracePeriod
+	}
+	return 5 * time.Second
+}
+
+func (sp *SOCKS5DialProxy) HandleConn(src net.Conn, rawSrc net.Conn) {
+	if sp.hooks != nil && sp.hooks.OnDialStart != nil {
+		sp.hooks.OnDialStart(rawSrc, sp.Addr)
+	}
+	ctx := context.Background()
+	var cancel context.CancelFunc
+	if sp.DialTimeout >= 0 {
+		ctx, cancel = context.WithTimeout(ctx, sp.dialTimeout())
+	}
+	dst, err := sp.dialContext()(ctx, "tcp", sp.ProxyAddr)
+	if err == nil {
+		// The handshake is a further round trip with the proxy, so
+		// it needs its own deadline: ctx's cancellation (if any)
+		// only bounded the dial above, and doesn't stop dst.Read
+		// from blocking forever against a proxy that accepts the
+		// TCP connection but never replies.
+		if dl, ok := ctx.Deadline(); ok {
+			dst.SetDeadline(dl)
+		}
+		err = sp.handshake(dst)
+		if err == nil {
+			dst.SetDeadline(time.Time{})
+		}
+	}
+	if cancel != nil {
+		cancel()
+	}
+	if sp.hooks != nil && sp.hooks.OnDialEnd != nil {
+		sp.hooks.OnDialEnd(rawSrc, sp.Addr, err)
+	}
+	if err != nil {
+		if dst != nil {
+			dst.Close()
+		}
+		sp.onDialError()(src, err)
+		return
+	}
+	defer src.Close()
+	defer dst.Close()
+	if ka := sp.keepAlivePeriod(); ka > 0 {
+		if c, ok := rawSrc.(*net.TCPConn); ok {
+			c.SetKeepAlive(true)
+			c.SetKeepAlivePeriod(ka)
+		}
+		if c, ok := dst.(*net.TCPConn); ok {
+			c.SetKeepAlive(true)
+			c.SetKeepAlivePeriod(ka)
+		}
+	}
+	if sp.shutdownc != nil {
+		stop := make(chan struct{})
+		defer close(stop)
+		go awaitShutdown(sp.shutdownc, stop, sp.shutdownGracePeriod(), src, dst)
+	}
+	var byteCount int64
+	runProxy(dst, src, rawSrc, &byteCount, sp.onBytes(rawSrc, true), sp.onBytes(rawSrc, false))
+}
+
+// onBytes returns a runProxy callback reporting n bytes copied on
+// behalf of rawSrc to sp.hooks.OnBytes, or nil if unset.
+func (sp *SOCKS5DialProxy) onBytes(rawSrc net.Conn, out bool) func(int64) {
+	if sp.hooks == nil || sp.hooks.OnBytes == nil {
+		return nil
+	}
+	onBytes := sp.hooks.OnBytes
+	return func(n int64) { onBytes(rawSrc, n, out) }
+}
+
+// handshake performs the SOCKS5 method negotiation, optional
+// username/password subnegotiation (RFC 1929), and CONNECT request
+// (RFC 1928) against conn, which must already be connected to the
+// SOCKS5 proxy.
+func (sp *SOCKS5DialProxy) handshake(conn net.Conn) error {
+	if sp.Username != "" {
+		if _, err := conn.Write([]byte{0x05, 0x02, 0x00, 0x02}); err != nil {
+			return err
+		}
+	} else {
+		if _, err := conn.Write([]byte{0x05, 0x01, 0x00}); err != nil {
+			return err
+		}
+	}
+	method, err := readMethodSelection(conn)
+	if err != nil {
+		return err
+	}
+	switch method {
+	case 0x00:
+		// No authentication required.
+	case 0x02:
+		if sp.Username == "" {
+			return errors.New("tcpproxy: SOCKS5 proxy requires username/password authentication")
+		}
+		if err := socks5Authenticate(conn, sp.Username, sp.Password); err != nil {
+			return err
+		}
+	case 0xff:
+		return errors.New("tcpproxy: SOCKS5 proxy rejected all offered authentication methods")
+	default:
+		return fmt.Errorf("tcpproxy: SOCKS5 proxy selected unsupported authentication method %#x", method)
+	}
+	return socks5Connect(conn, sp.Addr)
+}
+
+func readMethodSelection(conn net.Conn) (method byte, err error) {
+	var buf [2]byte
+	if _, err := readFull(conn, buf[:]); err != nil {
+		return 0, err
+	}
+	if buf[0] != 0x05 {
+		return 0, fmt.Errorf("tcpproxy: SOCKS5 proxy returned unexpected version %#x", buf[0])
+	}
+	return buf[1], nil
+}
+
+// socks5Authenticate performs the username/password subnegotiation
+// described in RFC 1929.
+func socks5Authenticate(conn net.Conn, username, password string) error {
+	if len(username) > 255 || len(password) > 255 {
+		return errors.New("tcpproxy: SOCKS5 username/password must each be at most 255 bytes")
+	}
+	req := make([]byte, 0, 3+len(username)+len(password))
+	req = append(req, 0x01, byte(len(username)))
+	req = append(req, username...)
+	req = append(req, byte(len(password)))
+	req = append(req, password...)
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+	var resp [2]byte
+	if _, err := readFull(conn, resp[:]); err != nil {
+		return err
+	}
+	if resp[1] != 0x00 {
+		return fmt.Errorf("tcpproxy: SOCKS5 proxy rejected username/password authentication (status %#x)", resp[1])
+	}
+	return nil
+}
+
+// socks5Connect sends a CONNECT request for addr and reads the
+// proxy's reply, returning an error unless the reply indicates
+// success.
+func socks5Connect(conn net.Conn, addr string) error {
+	req, err := socks5AddrRequest(addr)
+	if err != nil {
+		return err
+	}
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+	var head [4]byte
+	if _, err := readFull(conn, head[:]); err != nil {
+		return err
+	}
+	if head[0] != 0x05 {
+		return fmt.Errorf("tcpproxy: SOCKS5 proxy returned unexpected version %#x in CONNECT reply", head[0])
+	}
+	if head[1] != 0x00 {
+		return fmt.Errorf("tcpproxy: SOCKS5 proxy refused CONNECT (reply code %#x)", head[1])
+	}
+	// Drain the bound address the proxy reports back; we don't
+	// need it, but it must be read off the wire.
+	switch head[3] {
+	case 0x01: // IPv4
+		var b [4 + 2]byte
+		_, err = readFull(conn, b[:])
+	case 0x04: // IPv6
+		var b [16 + 2]byte
+		_, err = readFull(conn, b[:])
+	case 0x03: // domain name
+		var l [1]byte
+		if _, err = readFull(conn, l[:]); err != nil {
+			return err
+		}
+		b := make([]byte, int(l[0])+2)
+		_, err = readFull(conn, b)
+	default:
+		return fmt.Errorf("tcpproxy: SOCKS5 proxy returned unknown address type %#x in CONNECT reply", head[3])
+	}
+	return err
+}
+
+// socks5AddrRequest builds the "05 01 00 <ATYP> <addr> <port>" CONNECT
+// request for addr, which must be in host:port form.
+func socks5AddrRequest(addr string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("tcpproxy: invalid SOCKS5 target address %q: %w", addr, err)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("tcpproxy: invalid SOCKS5 target port %q: %w", portStr, err)
+	}
+	req := []byte{0x05, 0x01, 0x00}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			req = append(req, 0x01)
+			req = append(req, ip4...)
+		} else {
+			req = append(req, 0x04)
+			req = append(req, ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("tcpproxy: SOCKS5 target hostname %q too long", host)
+		}
+		req = append(req, 0x03, byte(len(host)))
+		req = append(req, host...)
+	}
+	req = append(req, byte(port>>8), byte(port))
+	return req, nil
+}
+
+func readFull(conn net.Conn, buf []byte) (int, error) {
+	n := 0
+	for n < len(buf) {
+		m, err := conn.Read(buf[n:])
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func (sp *SOCKS5DialProxy) keepAlivePeriod() time.Duration {
+	if sp.KeepAlivePeriod != 0 {
+		return sp.KeepAlivePeriod
+	}
+	return time.Minute
+}
+
+func (sp *SOCKS5DialProxy) dialTimeout() time.Duration {
+	if sp.DialTimeout > 0 {
+		return sp.DialTimeout
+	}
+	return 10 * time.Second
+}
+
+func (sp *SOCKS5DialProxy) dialContext() func(ctx context.Context, network, address string) (net.Conn, error) {
+	if sp.DialContext != nil {
+		return sp.DialContext
+	}
+	return defaultDialer.DialContext
+}
+
+func (sp *SOCKS5DialProxy) onDialError() func(src net.Conn, dstDialErr error) {
+	if sp.OnDialError != nil {
+		return sp.OnDialError
+	}
+	return func(src net.Conn, dstDialErr error) {
+		log.Printf("tcpproxy: for incoming conn %v, error dialing SOCKS5 proxy %q for %q: %v", src.RemoteAddr().String(), sp.ProxyAddr, sp.Addr, dstDialErr)
+		src.Close()
+	}
+}
@@ -0,0 +1,328 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tcpproxy
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// socks5ServerFunc implements the proxy side of a SOCKS5 handshake
+// against an already-accepted conn, returning any protocol error.
+type socks5ServerFunc func(c net.Conn) error
+
+// startFakeSOCKS5 runs fn against the first connection accepted on a
+// new loopback listener, reporting fn's result on the returned
+// channel. It's a stand-in for a real SOCKS5 proxy, letting tests
+// drive SOCKS5DialProxy against specific server behaviors (no-auth,
+// username/password, rejections) without a real Tor/SOCKS5 binary.
+func startFakeSOCKS5(t *testing.T, fn socks5ServerFunc) (addr string, done <-chan error) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	errc := make(chan error, 1)
+	go func() {
+		c, err := ln.Accept()
+		ln.Close()
+		if err != nil {
+			errc <- err
+			return
+		}
+		defer c.Close()
+		errc <- fn(c)
+	}()
+	return ln.Addr().String(), errc
+}
+
+// readSOCKS5MethodRequest reads and returns the offered authentication
+// methods from a client's greeting.
+func readSOCKS5MethodRequest(c net.Conn) ([]byte, error) {
+	var head [2]byte
+	if _, err := readFull(c, head[:]); err != nil {
+		return nil, err
+	}
+	if head[0] != 0x05 {
+		return nil, fmt.Errorf("got version %#x, want 0x05", head[0])
+	}
+	methods := make([]byte, head[1])
+	if _, err := readFull(c, methods); err != nil {
+		return nil, err
+	}
+	return methods, nil
+}
+
+// readSOCKS5ConnectRequest reads a CONNECT request and returns the
+// addr it names, in host:port form.
+func readSOCKS5ConnectRequest(c net.Conn) (string, error) {
+	var head [4]byte
+	if _, err := readFull(c, head[:]); err != nil {
+		return "", err
+	}
+	if head[0] != 0x05 || head[1] != 0x01 {
+		return "", fmt.Errorf("got ver/cmd %#x/%#x, want 0x05/0x01", head[0], head[1])
+	}
+	var host string
+	switch head[3] {
+	case 0x01:
+		var b [4]byte
+		if _, err := readFull(c, b[:]); err != nil {
+			return "", err
+		}
+		host = net.IP(b[:]).String()
+	case 0x04:
+		var b [16]byte
+		if _, err := readFull(c, b[:]); err != nil {
+			return "", err
+		}
+		host = net.IP(b[:]).String()
+	case 0x03:
+		var l [1]byte
+		if _, err := readFull(c, l[:]); err != nil {
+			return "", err
+		}
+		b := make([]byte, l[0])
+		if _, err := readFull(c, b); err != nil {
+			return "", err
+		}
+		host = string(b)
+	default:
+		return "", fmt.Errorf("unknown ATYP %#x", head[3])
+	}
+	var portb [2]byte
+	if _, err := readFull(c, portb[:]); err != nil {
+		return "", err
+	}
+	port := int(portb[0])<<8 | int(portb[1])
+	return net.JoinHostPort(host, fmt.Sprint(port)), nil
+}
+
+// writeSOCKS5ConnectReply writes a CONNECT reply with the given reply
+// code and an arbitrary IPv4 bound address.
+func writeSOCKS5ConnectReply(c net.Conn, replyCode byte) error {
+	_, err := c.Write([]byte{0x05, replyCode, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+func dialViaSOCKS5(t *testing.T, sp *SOCKS5DialProxy) (clientConn net.Conn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		sp.HandleConn(c, c)
+	}()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return conn
+}
+
+func TestSOCKS5DialProxyNoAuth(t *testing.T) {
+	const want = "request"
+	const response = "response"
+	addr, done := startFakeSOCKS5(t, func(c net.Conn) error {
+		methods, err := readSOCKS5MethodRequest(c)
+		if err != nil {
+			return err
+		}
+		if len(methods) != 1 || methods[0] != 0x00 {
+			return fmt.Errorf("got methods %v, want [0x00] (no auth)", methods)
+		}
+		if _, err := c.Write([]byte{0x05, 0x00}); err != nil {
+			return err
+		}
+		target, err := readSOCKS5ConnectRequest(c)
+		if err != nil {
+			return err
+		}
+		if target != "example.com:80" {
+			return fmt.Errorf("got CONNECT target %q, want %q", target, "example.com:80")
+		}
+		if err := writeSOCKS5ConnectReply(c, 0x00); err != nil {
+			return err
+		}
+		req, err := io.ReadAll(io.LimitReader(c, int64(len(want))))
+		if err != nil {
+			return err
+		}
+		if string(req) != want {
+			return fmt.Errorf("got tunnel payload %q, want %q", req, want)
+		}
+		_, err = c.Write([]byte(response))
+		return err
+	})
+
+	sp := &SOCKS5DialProxy{ProxyAddr: addr, Addr: "example.com:80"}
+	conn := dialViaSOCKS5(t, sp)
+	if _, err := io.WriteString(conn, want); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(response))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != response {
+		t.Errorf("got response %q, want %q", got, response)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("fake SOCKS5 server: %v", err)
+	}
+}
+
+func TestSOCKS5DialProxyUsernamePassword(t *testing.T) {
+	const username, password = "alice", "hunter2"
+	addr, done := startFakeSOCKS5(t, func(c net.Conn) error {
+		methods, err := readSOCKS5MethodRequest(c)
+		if err != nil {
+			return err
+		}
+		if len(methods) != 2 || methods[0] != 0x00 || methods[1] != 0x02 {
+			return fmt.Errorf("got methods %v, want [0x00, 0x02] (no auth, user/pass)", methods)
+		}
+		if _, err := c.Write([]byte{0x05, 0x02}); err != nil {
+			return err
+		}
+		var head [2]byte
+		if _, err := readFull(c, head[:]); err != nil {
+			return err
+		}
+		if head[0] != 0x01 {
+			return fmt.Errorf("got auth subnegotiation version %#x, want 0x01", head[0])
+		}
+		u := make([]byte, head[1])
+		if _, err := readFull(c, u); err != nil {
+			return err
+		}
+		var plen [1]byte
+		if _, err := readFull(c, plen[:]); err != nil {
+			return err
+		}
+		p := make([]byte, plen[0])
+		if _, err := readFull(c, p); err != nil {
+			return err
+		}
+		if string(u) != username || string(p) != password {
+			c.Write([]byte{0x01, 0x01})
+			return fmt.Errorf("got username/password %q/%q, want %q/%q", u, p, username, password)
+		}
+		if _, err := c.Write([]byte{0x01, 0x00}); err != nil {
+			return err
+		}
+		if _, err := readSOCKS5ConnectRequest(c); err != nil {
+			return err
+		}
+		return writeSOCKS5ConnectReply(c, 0x00)
+	})
+
+	sp := &SOCKS5DialProxy{ProxyAddr: addr, Addr: "example.com:80", Username: username, Password: password}
+	dialViaSOCKS5(t, sp)
+	if err := <-done; err != nil {
+		t.Fatalf("fake SOCKS5 server: %v", err)
+	}
+}
+
+func TestSOCKS5DialProxyAuthRejected(t *testing.T) {
+	addr, done := startFakeSOCKS5(t, func(c net.Conn) error {
+		if _, err := readSOCKS5MethodRequest(c); err != nil {
+			return err
+		}
+		// Reject every offered method.
+		_, err := c.Write([]byte{0x05, 0xff})
+		return err
+	})
+
+	errc := make(chan error, 1)
+	sp := &SOCKS5DialProxy{
+		ProxyAddr: addr,
+		Addr:      "example.com:80",
+		OnDialError: func(src net.Conn, err error) {
+			errc <- err
+		},
+	}
+	dialViaSOCKS5(t, sp)
+	select {
+	case err := <-errc:
+		if err == nil {
+			t.Error("OnDialError called with nil error, want rejection error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnDialError was never called")
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("fake SOCKS5 server: %v", err)
+	}
+}
+
+func TestSOCKS5DialProxyConnectRefused(t *testing.T) {
+	addr, done := startFakeSOCKS5(t, func(c net.Conn) error {
+		if _, err := readSOCKS5MethodRequest(c); err != nil {
+			return err
+		}
+		if _, err := c.Write([]byte{0x05, 0x00}); err != nil {
+			return err
+		}
+		if _, err := readSOCKS5ConnectRequest(c); err != nil {
+			return err
+		}
+		// 0x05: connection refused by destination host.
+		return writeSOCKS5ConnectReply(c, 0x05)
+	})
+
+	errc := make(chan error, 1)
+	sp := &SOCKS5DialProxy{
+		ProxyAddr: addr,
+		Addr:      "example.com:80",
+		OnDialError: func(src net.Conn, err error) {
+			errc <- err
+		},
+	}
+	dialViaSOCKS5(t, sp)
+	select {
+	case err := <-errc:
+		if err == nil {
+			t.Error("OnDialError called with nil error, want CONNECT refusal error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnDialError was never called")
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("fake SOCKS5 server: %v", err)
+	}
+}
+
+func TestSocks5AddrRequest(t *testing.T) {
+	tests := []struct {
+		addr string
+		want []byte
+	}{
+		{"192.0.2.1:80", []byte{0x05, 0x01, 0x00, 0x01, 192, 0, 2, 1, 0, 80}},
+		{"[2001:db8::1]:443", append(append([]byte{0x05, 0x01, 0x00, 0x04}, net.ParseIP("2001:db8::1").To16()...), 1, 187)},
+		{"example.com:80", append([]byte{0x05, 0x01, 0x00, 0x03, byte(len("example.com"))}, append([]byte("example.com"), 0, 80)...)},
+	}
+	for _, tt := range tests {
+		got, err := socks5AddrRequest(tt.addr)
+		if err != nil {
+			t.Errorf("socks5AddrRequest(%q): %v", tt.addr, err)
+			continue
+		}
+		if string(got) != string(tt.want) {
+			t.Errorf("socks5AddrRequest(%q) = % x, want % x", tt.addr, got, tt.want)
+		}
+	}
+}
@@ -6,14 +6,14 @@
 //
 // Typical usage:
 //
-//     var p tcpproxy.Proxy
-//     p.AddHTTPHostRoute(":80", "foo.com", tcpproxy.To("10.0.0.1:8081"))
-//     p.AddHTTPHostRoute(":80", "bar.com", tcpproxy.To("10.0.0.2:8082"))
-//     p.AddRoute(":80", tcpproxy.To("10.0.0.1:8081")) // fallback
-//     p.AddSNIHostRoute(":443", "foo.com", tcpproxy.To("10.0.0.1:4431"))
-//     p.AddSNIHostRoute(":443", "bar.com", tcpproxy.To("10.0.0.2:4432"))
-//     p.AddRoute(":443", tcpproxy.To("10.0.0.1:4431")) // fallback
-//     log.Fatal(p.Run())
+//	var p tcpproxy.Proxy
+//	p.AddHTTPHostRoute(":80", "foo.com", tcpproxy.To("10.0.0.1:8081"))
+//	p.AddHTTPHostRoute(":80", "bar.com", tcpproxy.To("10.0.0.2:8082"))
+//	p.AddRoute(":80", tcpproxy.To("10.0.0.1:8081")) // fallback
+//	p.AddSNIHostRoute(":443", "foo.com", tcpproxy.To("10.0.0.1:4431"))
+//	p.AddSNIHostRoute(":443", "bar.com", tcpproxy.To("10.0.0.2:4432"))
+//	p.AddRoute(":443", tcpproxy.To("10.0.0.1:4431")) // fallback
+//	log.Fatal(p.Run())
 package tcpproxy
 
 import (
@@ -21,9 +21,12 @@ import (
 	"bytes"
 	"context"
 	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -36,10 +39,77 @@ type Proxy struct {
 	donec chan struct{} // closed before err
 	err   error         // any error from listening
 
+	wg          sync.WaitGroup // tracks in-flight serveConn calls, for Shutdown
+	activeConns int64          // atomic; number of in-flight serveConn calls
+
+	quit          chan struct{} // closed by Shutdown to ask dialing Targets to wrap up soon
+	quitOnce      sync.Once
+	closeQuitOnce sync.Once
+
 	// ListenFunc optionally specifies an alternate listen
 	// function. If nil, net.Dial is used.
 	// The provided net is always "tcp".
 	ListenFunc func(net, laddr string) (net.Listener, error)
+
+	// Hooks, if non-zero, is used to observe the Proxy's
+	// connection lifecycle: accepts, route matches, and dials
+	// made on its behalf by dialing Targets such as DialProxy.
+	// It's most useful for exporting metrics (bytes in/out per
+	// route, active conns, dial errors, match failures) to a
+	// Prometheus-style collector without forking tcpproxy.
+	Hooks Hooks
+}
+
+// Hooks lets callers observe a Proxy's connection lifecycle. All
+// fields are optional; a nil func is simply not called.
+type Hooks struct {
+	// OnAccept is called for each connection accepted on one of
+	// the Proxy's listeners, before route matching.
+	OnAccept func(c net.Conn)
+
+	// OnMatch is called when c is matched to dest by a route.
+	OnMatch func(c net.Conn, dest Target)
+
+	// OnNoMatch is called instead of OnMatch when no route
+	// matches c. The Proxy closes c immediately afterward;
+	// OnNoMatch replaces the default "no routes matched" log line.
+	OnNoMatch func(c net.Conn)
+
+	// OnClose is called once c's lifecycle has ended: either
+	// because no route matched and c was closed, or because the
+	// matched Target's HandleConn returned.
+	OnClose func(c net.Conn)
+
+	// OnDialStart is called by dialing Targets (such as DialProxy)
+	// immediately before dialing addr on behalf of src.
+	OnDialStart func(src net.Conn, addr string)
+
+	// OnDialEnd is called by dialing Targets after a dial to addr
+	// on behalf of src completes, whether or not it succeeded.
+	OnDialEnd func(src net.Conn, addr string, err error)
+
+	// OnBytes is called by dialing Targets as bytes are copied
+	// between src and the dialed backend connection. out is true
+	// for bytes read from src (client to backend) and false for
+	// bytes written back to src (backend to client).
+	OnBytes func(src net.Conn, n int64, out bool)
+}
+
+// hookTarget is implemented by Targets that can make use of a
+// Proxy's Hooks, such as DialProxy. addRoute wires it up
+// automatically; Targets used without a Proxy simply see a nil
+// *Hooks and skip hook invocations.
+type hookTarget interface {
+	setHooks(h *Hooks)
+}
+
+// shutdownTarget is implemented by Targets that can wrap up early
+// when asked to, such as DialProxy. addRoute wires it up
+// automatically, so Proxy.Shutdown can ask in-flight connections to
+// finish soon once its context expires; Targets used without a Proxy
+// simply see a nil channel and never receive that signal.
+type shutdownTarget interface {
+	setShutdownC(c <-chan struct{})
 }
 
 type route struct {
@@ -47,8 +117,12 @@ type route struct {
 	target  Target
 }
 
+// matcher decides whether a route applies to a connection. br lets
+// byte-sniffing matchers (HTTP Host, TLS SNI) peek at the start of
+// the stream; c lets matchers that only care about the client
+// address (such as CIDR-based ACLs) decide without touching bytes.
 type matcher interface {
-	match(*bufio.Reader) bool
+	match(br *bufio.Reader, c net.Conn) bool
 }
 
 func (p *Proxy) netListen() func(net, laddr string) (net.Listener, error) {
@@ -62,9 +136,22 @@ func (p *Proxy) addRoute(ipPort string, matcher matcher, dest Target) {
 	if p.routes == nil {
 		p.routes = make(map[string][]route)
 	}
+	if ht, ok := dest.(hookTarget); ok {
+		ht.setHooks(&p.Hooks)
+	}
+	if st, ok := dest.(shutdownTarget); ok {
+		st.setShutdownC(p.quitCh())
+	}
 	p.routes[ipPort] = append(p.routes[ipPort], route{matcher, dest})
 }
 
+// quitCh lazily creates and returns the channel Shutdown closes to
+// ask in-flight dialing Targets to wrap up soon.
+func (p *Proxy) quitCh() chan struct{} {
+	p.quitOnce.Do(func() { p.quit = make(chan struct{}) })
+	return p.quit
+}
+
 // AddRoute appends an always-matching route to the ipPort listener,
 // directing any connection to dest.
 //
@@ -78,7 +165,7 @@ func (p *Proxy) AddRoute(ipPort string, dest Target) {
 
 type alwaysMatch struct{}
 
-func (alwaysMatch) match(*bufio.Reader) bool { return true }
+func (alwaysMatch) match(*bufio.Reader, net.Conn) bool { return true }
 
 // Run is calls Start, and then Wait.
 //
@@ -108,6 +195,39 @@ func (p *Proxy) Close() error {
 	return nil
 }
 
+// ActiveConns returns the number of connections currently being
+// served across all of the Proxy's listeners.
+func (p *Proxy) ActiveConns() int {
+	return int(atomic.LoadInt64(&p.activeConns))
+}
+
+// Shutdown stops the Proxy from accepting new connections on all its
+// listeners, the same way Close does, and then waits for in-flight
+// connections to finish being served. If ctx is done before they've
+// all finished on their own, Shutdown asks any in-flight dialing
+// Targets (such as DialProxy) to wrap up soon, by having them set a
+// short deadline on their connections, then waits for that to take
+// effect and returns ctx.Err().
+//
+// This mirrors http.Server.Shutdown and is meant for zero-downtime
+// deploys and rolling restarts of proxies fronting stateful backends.
+func (p *Proxy) Shutdown(ctx context.Context) error {
+	p.Close()
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+	p.closeQuitOnce.Do(func() { close(p.quitCh()) })
+	<-done
+	return ctx.Err()
+}
+
 // Start creates a TCP listener for each unique ipPort from the
 // previously created routes and starts the proxy. It returns any
 // error from starting listeners.
@@ -146,6 +266,7 @@ func (p *Proxy) serveListener(ret chan<- error, ln net.Listener, routes []route)
 			ret <- err
 			return
 		}
+		p.wg.Add(1)
 		go p.serveConn(c, routes)
 	}
 }
@@ -153,26 +274,52 @@ func (p *Proxy) serveListener(ret chan<- error, ln net.Listener, routes []route)
 // serveConn runs in its own goroutine and matches c against routes.
 // It returns whether it matched purely for testing.
 func (p *Proxy) serveConn(c net.Conn, routes []route) bool {
+	atomic.AddInt64(&p.activeConns, 1)
+	defer atomic.AddInt64(&p.activeConns, -1)
+	defer p.wg.Done()
+	if p.Hooks.OnAccept != nil {
+		p.Hooks.OnAccept(c)
+	}
 	br := bufio.NewReader(c)
 	for _, route := range routes {
-		if route.matcher.match(br) {
+		if route.matcher.match(br, c) {
+			if p.Hooks.OnMatch != nil {
+				p.Hooks.OnMatch(c, route.target)
+			}
 			buffered, _ := br.Peek(br.Buffered())
 			route.target.HandleConn(changeReaderConn{
-				r:    io.MultiReader(bytes.NewReader(buffered), c),
-				Conn: c,
+				r:      io.MultiReader(bytes.NewReader(buffered), c),
+				prefix: buffered,
+				Conn:   c,
 			}, c)
+			if p.Hooks.OnClose != nil {
+				p.Hooks.OnClose(c)
+			}
 			return true
 		}
 	}
-	// TODO: hook for this?
-	log.Printf("tcpproxy: no routes matched conn %v/%v; closing", c.RemoteAddr().String(), c.LocalAddr().String())
+	if p.Hooks.OnNoMatch != nil {
+		p.Hooks.OnNoMatch(c)
+	} else {
+		log.Printf("tcpproxy: no routes matched conn %v/%v; closing", c.RemoteAddr().String(), c.LocalAddr().String())
+	}
 	c.Close()
+	if p.Hooks.OnClose != nil {
+		p.Hooks.OnClose(c)
+	}
 	return false
 }
 
 // changeReaderConn is a net.Conn wrapper with a separate reader function.
+//
+// prefix holds the bytes already pulled off the wire and peeked by
+// the matching bufio.Reader, which r replays ahead of the
+// underlying Conn. Targets that want the splice/sendfile fast path
+// use prefix to drain that replay before switching to reading the
+// underlying (rawConn) Conn directly; see runProxy.
 type changeReaderConn struct {
-	r io.Reader
+	r      io.Reader
+	prefix []byte
 	net.Conn
 }
 
@@ -227,9 +374,45 @@ type DialProxy struct {
 	// If nil, the error is logged and src is closed.
 	// If non-nil, src is not closed automatically.
 	OnDialError func(src net.Conn, dstDialErr error)
+
+	// ProxyProtocol, if not ProxyProtoOff, causes a HAProxy PROXY
+	// protocol header describing rawSrc's remote and local
+	// addresses to be written to dst before any other bytes are
+	// copied. This lets Addr learn the original client address
+	// even though the connection arrives from the proxy.
+	ProxyProtocol ProxyProtoVersion
+
+	// ShutdownGracePeriod is how long a connection is given to
+	// finish up on its own once its Proxy's Shutdown deadline
+	// expires, before HandleConn forces it closed by setting a
+	// deadline on both ends. If zero, a default is used.
+	ShutdownGracePeriod time.Duration
+
+	// hooks is set by addRoute to the owning Proxy's Hooks. It's
+	// nil when DialProxy is used directly as a Target without going
+	// through a Proxy.
+	hooks *Hooks
+
+	// shutdownc is set by addRoute to the owning Proxy's shutdown
+	// channel. It's nil when DialProxy is used directly as a
+	// Target without going through a Proxy.
+	shutdownc <-chan struct{}
+}
+
+func (dp *DialProxy) setHooks(h *Hooks)              { dp.hooks = h }
+func (dp *DialProxy) setShutdownC(c <-chan struct{}) { dp.shutdownc = c }
+
+func (dp *DialProxy) shutdownGracePeriod() time.Duration {
+	if dp.ShutdownGracePeriod > 0 {
+		return dp.ShutdownGracePeriod
+	}
+	return 5 * time.Second
 }
 
 func (dp *DialProxy) HandleConn(src net.Conn, rawSrc net.Conn) {
+	if dp.hooks != nil && dp.hooks.OnDialStart != nil {
+		dp.hooks.OnDialStart(rawSrc, dp.Addr)
+	}
 	ctx := context.Background()
 	var cancel context.CancelFunc
 	if dp.DialTimeout >= 0 {
@@ -239,6 +422,9 @@ func (dp *DialProxy) HandleConn(src net.Conn, rawSrc net.Conn) {
 	if cancel != nil {
 		cancel()
 	}
+	if dp.hooks != nil && dp.hooks.OnDialEnd != nil {
+		dp.hooks.OnDialEnd(rawSrc, dp.Addr, err)
+	}
 	if err != nil {
 		dp.onDialError()(src, err)
 		return
@@ -255,23 +441,168 @@ func (dp *DialProxy) HandleConn(src net.Conn, rawSrc net.Conn) {
 			c.SetKeepAlivePeriod(ka)
 		}
 	}
-	errc := make(chan error, 1)
-	go proxyCopy(errc, src, dst)
-	go proxyCopy(errc, dst, src)
+	if dp.ProxyProtocol != ProxyProtoOff {
+		if err := writeProxyHeader(dst, dp.ProxyProtocol, rawSrc.RemoteAddr(), rawSrc.LocalAddr()); err != nil {
+			dp.onDialError()(src, fmt.Errorf("writing PROXY protocol header to %q: %w", dp.Addr, err))
+			return
+		}
+	}
+	if dp.shutdownc != nil {
+		stop := make(chan struct{})
+		defer close(stop)
+		go awaitShutdown(dp.shutdownc, stop, dp.shutdownGracePeriod(), src, dst)
+	}
+	var byteCount int64 // shared, atomically updated total for both directions
+	runProxy(dst, src, rawSrc, &byteCount, dp.onBytes(rawSrc, true), dp.onBytes(rawSrc, false))
+}
+
+// awaitShutdown waits for either shutdownc to be closed (the owning
+// Proxy's Shutdown deadline expired) or stop to be closed (HandleConn
+// returned on its own first). In the former case, it sets a deadline
+// grace in the future on both conns, so their next Read/Write returns
+// and the blocked copy loops in runProxy unwind.
+func awaitShutdown(shutdownc, stop <-chan struct{}, grace time.Duration, conns ...net.Conn) {
+	select {
+	case <-shutdownc:
+		deadline := time.Now().Add(grace)
+		for _, c := range conns {
+			c.SetDeadline(deadline)
+		}
+	case <-stop:
+	}
+}
+
+// onBytes returns a runProxy callback that reports n bytes copied on
+// behalf of rawSrc to dp.hooks.OnBytes, or nil if no OnBytes hook is
+// set. out is true for bytes read from rawSrc (client to backend)
+// and false for bytes written back to it (backend to client).
+func (dp *DialProxy) onBytes(rawSrc net.Conn, out bool) func(int64) {
+	if dp.hooks == nil || dp.hooks.OnBytes == nil {
+		return nil
+	}
+	onBytes := dp.hooks.OnBytes
+	return func(n int64) { onBytes(rawSrc, n, out) }
+}
+
+// bufferPool recycles the buffers used by copyBuffer, avoiding the
+// per-call allocation io.Copy makes when neither side implements
+// io.ReaderFrom/io.WriterTo.
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 32*1024)
+		return &b
+	},
+}
+
+// runProxy copies bytes in both directions between rawSrc and dst,
+// one goroutine per direction. It blocks until both directions have
+// finished.
+//
+// src is the possibly-wrapped Conn Targets were handed (carrying any
+// bytes already peeked off the wire by route matching); rawSrc is
+// the same connection with no wrapping, suitable for type assertions.
+// Once src's peeked prefix (if any) has been drained to dst, both
+// directions switch to reading and writing rawSrc and dst directly:
+// when both ends of a direction are *net.TCPConn, that lets
+// ReadFrom trigger the kernel's splice/sendfile fast path instead of
+// copying through a userspace buffer. This applies symmetrically:
+// client-to-backend can splice, and so can backend-to-client, since
+// rawSrc carries the same bytes as src with none of its wrapping.
+//
+// total is shared between both directions and updated atomically, so
+// callers can read it at any time to publish the connection's
+// running byte count. onBytesUp and onBytesDown, if non-nil, are
+// additionally called as bytes are copied client-to-backend and
+// backend-to-client respectively.
+//
+// Each direction half-closes its destination's write side once its
+// source hits EOF, so a client (or backend) that only closes its
+// write side keeps receiving the in-flight response instead of
+// having the whole connection torn down early.
+func runProxy(dst, src, rawSrc net.Conn, total *int64, onBytesUp, onBytesDown func(int64)) {
+	errc := make(chan error, 2)
+	go func() {
+		err := copyDirection(dst, src, rawSrc, total, onBytesUp)
+		closeWrite(dst)
+		errc <- err
+	}()
+	go func() {
+		err := copyDirection(rawSrc, dst, dst, total, onBytesDown)
+		closeWrite(rawSrc)
+		errc <- err
+	}()
+	<-errc
 	<-errc
 }
 
-// proxyCopy is the function that copies bytes around.
-// It's a named function instead of a func literal so users get
-// named goroutines in debug goroutine stack dumps.
-func proxyCopy(errc chan<- error, dst io.Writer, src io.Reader) {
-	// TODO: make caller switch from src to rawSrc after N bytes (e.g. 4KB)
-	// if the io.Copy optimization to switch to Linux splice happens.
-	// TODO: if the runtime provides a way to wait for
-	// readability, use that to avoid stranding big blocks of
-	// memory blocked in idle reads.
-	_, err := io.Copy(dst, src)
-	errc <- err
+// copyDirection copies src to dst, using rawSrc (see runProxy) for
+// the post-prefix fast path. onBytes, if non-nil, is called with the
+// number of bytes copied; it may be called once with the whole
+// count, rather than once per chunk, when the splice fast path is
+// used.
+func copyDirection(dst, src, rawSrc net.Conn, total *int64, onBytes func(int64)) error {
+	if crc, ok := src.(changeReaderConn); ok && len(crc.prefix) > 0 {
+		if _, err := dst.Write(crc.prefix); err != nil {
+			return err
+		}
+		atomic.AddInt64(total, int64(len(crc.prefix)))
+		if onBytes != nil {
+			onBytes(int64(len(crc.prefix)))
+		}
+	}
+	if tdst, ok := dst.(*net.TCPConn); ok {
+		if tsrc, ok := rawSrc.(*net.TCPConn); ok {
+			n, err := tdst.ReadFrom(tsrc)
+			if n > 0 {
+				atomic.AddInt64(total, n)
+				if onBytes != nil {
+					onBytes(n)
+				}
+			}
+			return err
+		}
+	}
+	return copyBuffer(dst, rawSrc, total, onBytes)
+}
+
+// copyBuffer is the io.Copy fallback for when the splice fast path
+// in copyDirection doesn't apply, using a pooled buffer instead of
+// allocating one per call.
+func copyBuffer(dst io.Writer, src io.Reader, total *int64, onBytes func(int64)) error {
+	bufp := bufferPool.Get().(*[]byte)
+	defer bufferPool.Put(bufp)
+	buf := *bufp
+	for {
+		nr, er := src.Read(buf)
+		if nr > 0 {
+			atomic.AddInt64(total, int64(nr))
+			if onBytes != nil {
+				onBytes(int64(nr))
+			}
+			nw, ew := dst.Write(buf[:nr])
+			if ew != nil {
+				return ew
+			}
+			if nr != nw {
+				return io.ErrShortWrite
+			}
+		}
+		if er != nil {
+			if er == io.EOF {
+				return nil
+			}
+			return er
+		}
+	}
+}
+
+// closeWrite half-closes c's write side, if it supports it (as
+// *net.TCPConn does), so its peer sees EOF without the whole
+// connection being torn down.
+func closeWrite(c net.Conn) {
+	if cw, ok := c.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	}
 }
 
 func (dp *DialProxy) keepAlivePeriod() time.Duration {
@@ -305,4 +636,4 @@ func (dp *DialProxy) onDialError() func(src net.Conn, dstDialErr error) {
 		log.Printf("tcpproxy: for incoming conn %v, error dialing %q: %v", src.RemoteAddr().String(), dp.Addr, dstDialErr)
 		src.Close()
 	}
-}
\ No newline at end of file
+}
@@ -0,0 +1,429 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tcpproxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestHalfClose verifies that a client which closes its write side
+// after sending its request still receives the backend's full
+// response, rather than having the whole connection torn down as
+// soon as one direction hits EOF. See runProxy.
+func TestHalfClose(t *testing.T) {
+	backendLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backendLn.Close()
+
+	const request = "request"
+	const response = "the rest of the response, sent after the client half-closed"
+	backendErrc := make(chan error, 1)
+	go func() {
+		c, err := backendLn.Accept()
+		if err != nil {
+			backendErrc <- err
+			return
+		}
+		defer c.Close()
+		req, err := io.ReadAll(c)
+		if err != nil {
+			backendErrc <- err
+			return
+		}
+		if string(req) != request {
+			backendErrc <- fmt.Errorf("backend read request %q, want %q", req, request)
+			return
+		}
+		_, err = io.WriteString(c, response)
+		backendErrc <- err
+	}()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	var p Proxy
+	p.ListenFunc = func(string, string) (net.Listener, error) { return ln, nil }
+	p.AddRoute(ln.Addr().String(), To(backendLn.Addr().String()))
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := io.WriteString(conn, request); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("reading response after half-close: %v", err)
+	}
+	if string(got) != response {
+		t.Errorf("got response %q, want %q", got, response)
+	}
+	if err := <-backendErrc; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// BenchmarkProxyThroughput measures the throughput of proxying a
+// large payload from a backend to a client, exercising the
+// splice/sendfile fast path in copyDirection on platforms where
+// net.TCPConn.ReadFrom supports it.
+func BenchmarkProxyThroughput(b *testing.B) {
+	backendLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer backendLn.Close()
+
+	const chunkSize = 1 << 20 // 1 MiB
+	chunk := bytes.Repeat([]byte("x"), chunkSize)
+	backendErrc := make(chan error, 1)
+	go func() {
+		c, err := backendLn.Accept()
+		if err != nil {
+			backendErrc <- err
+			return
+		}
+		defer c.Close()
+		for i := 0; i < b.N; i++ {
+			if _, err := c.Write(chunk); err != nil {
+				backendErrc <- err
+				return
+			}
+		}
+		backendErrc <- nil
+	}()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer ln.Close()
+	var p Proxy
+	p.ListenFunc = func(string, string) (net.Listener, error) { return ln, nil }
+	p.AddRoute(ln.Addr().String(), To(backendLn.Addr().String()))
+	if err := p.Start(); err != nil {
+		b.Fatal(err)
+	}
+	defer p.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+
+	buf := make([]byte, chunkSize)
+	b.SetBytes(chunkSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+
+	if err := <-backendErrc; err != nil {
+		b.Fatal(err)
+	}
+}
+
+// hookRecorder records the order in which a Proxy's Hooks fire, along
+// with enough of their arguments to check for correctness, guarded by
+// a mutex since hooks can fire from multiple goroutines (accept,
+// dial, and the two copy directions).
+type hookRecorder struct {
+	mu        sync.Mutex
+	events    []string
+	bytesUp   int64
+	bytesDown int64
+}
+
+func (r *hookRecorder) record(event string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, event)
+}
+
+func (r *hookRecorder) hooks() Hooks {
+	return Hooks{
+		OnAccept:    func(c net.Conn) { r.record("accept") },
+		OnMatch:     func(c net.Conn, dest Target) { r.record("match") },
+		OnNoMatch:   func(c net.Conn) { r.record("nomatch") },
+		OnClose:     func(c net.Conn) { r.record("close") },
+		OnDialStart: func(src net.Conn, addr string) { r.record("dialstart") },
+		OnDialEnd:   func(src net.Conn, addr string, err error) { r.record("dialend") },
+		OnBytes: func(src net.Conn, n int64, out bool) {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			if out {
+				r.bytesUp += n
+			} else {
+				r.bytesDown += n
+			}
+		},
+	}
+}
+
+// TestHooks verifies that a Proxy's Hooks fire in the expected order
+// for a connection that's accepted, matched,
+// dialed, and proxied to a backend, including that OnBytes reports
+// the client-to-backend and backend-to-client byte counts under the
+// right out value.
+func TestHooks(t *testing.T) {
+	const request = "request"
+	const response = "response"
+	backendLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backendLn.Close()
+	backendErrc := make(chan error, 1)
+	go func() {
+		c, err := backendLn.Accept()
+		if err != nil {
+			backendErrc <- err
+			return
+		}
+		defer c.Close()
+		req := make([]byte, len(request))
+		if _, err := io.ReadFull(c, req); err != nil {
+			backendErrc <- err
+			return
+		}
+		if string(req) != request {
+			backendErrc <- fmt.Errorf("backend read request %q, want %q", req, request)
+			return
+		}
+		_, err = io.WriteString(c, response)
+		backendErrc <- err
+	}()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	var rec hookRecorder
+	var p Proxy
+	p.Hooks = rec.hooks()
+	p.ListenFunc = func(string, string) (net.Listener, error) { return ln, nil }
+	p.AddRoute(ln.Addr().String(), To(backendLn.Addr().String()))
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := io.WriteString(conn, request); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(response))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != response {
+		t.Errorf("got response %q, want %q", got, response)
+	}
+	conn.Close()
+	if err := <-backendErrc; err != nil {
+		t.Fatal(err)
+	}
+
+	// OnClose fires from serveConn's goroutine only once HandleConn
+	// has returned, which happens asynchronously after conn.Close()
+	// above; wait for it to be recorded.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		rec.mu.Lock()
+		n := len(rec.events)
+		rec.mu.Unlock()
+		if n >= 5 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	rec.mu.Lock()
+	events := append([]string(nil), rec.events...)
+	bytesUp, bytesDown := rec.bytesUp, rec.bytesDown
+	rec.mu.Unlock()
+
+	wantEvents := []string{"accept", "match", "dialstart", "dialend", "close"}
+	if len(events) != len(wantEvents) {
+		t.Fatalf("got hook events %v, want %v", events, wantEvents)
+	}
+	for i, e := range events {
+		if e != wantEvents[i] {
+			t.Errorf("event %d = %q, want %q (got full sequence %v)", i, e, wantEvents[i], events)
+		}
+	}
+	if bytesUp != int64(len(request)) {
+		t.Errorf("OnBytes out=true total = %d, want %d", bytesUp, len(request))
+	}
+	if bytesDown != int64(len(response)) {
+		t.Errorf("OnBytes out=false total = %d, want %d", bytesDown, len(response))
+	}
+}
+
+// TestHooksNoMatch verifies that OnNoMatch fires (and OnMatch does
+// not) for a connection that no route matches.
+func TestHooksNoMatch(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	var rec hookRecorder
+	var p Proxy
+	p.Hooks = rec.hooks()
+	p.ListenFunc = func(string, string) (net.Listener, error) { return ln, nil }
+	// A route that never matches, so every conn falls through to OnNoMatch.
+	if err := p.AddRouteByClientCIDR(ln.Addr().String(), []string{"192.0.2.0/24"}, To("127.0.0.1:1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	// The proxy closes unmatched conns; observe that as EOF.
+	buf := make([]byte, 1)
+	if _, err := conn.Read(buf); err != io.EOF {
+		t.Errorf("got err %v reading from unmatched conn, want io.EOF", err)
+	}
+	conn.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		rec.mu.Lock()
+		n := len(rec.events)
+		rec.mu.Unlock()
+		if n >= 3 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	rec.mu.Lock()
+	events := append([]string(nil), rec.events...)
+	rec.mu.Unlock()
+
+	wantEvents := []string{"accept", "nomatch", "close"}
+	if len(events) != len(wantEvents) {
+		t.Fatalf("got hook events %v, want %v", events, wantEvents)
+	}
+	for i, e := range events {
+		if e != wantEvents[i] {
+			t.Errorf("event %d = %q, want %q (got full sequence %v)", i, e, wantEvents[i], events)
+		}
+	}
+}
+
+// TestShutdown verifies that Shutdown drains a connection to a
+// deliberately-stuck backend within ctx's deadline plus the
+// DialProxy's grace period, rather than hanging forever or returning
+// before the connection has actually been torn down.
+func TestShutdown(t *testing.T) {
+	backendLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backendLn.Close()
+	go func() {
+		c, err := backendLn.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		// Never write or close on its own: this connection only ever
+		// ends via the deadline Shutdown forces on it.
+		io.ReadAll(c)
+	}()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	var p Proxy
+	p.ListenFunc = func(string, string) (net.Listener, error) { return ln, nil }
+	const grace = 100 * time.Millisecond
+	p.AddRoute(ln.Addr().String(), &DialProxy{
+		Addr:                backendLn.Addr().String(),
+		ShutdownGracePeriod: grace,
+	})
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for p.ActiveConns() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("conn never became active")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	const ctxTimeout = 100 * time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), ctxTimeout)
+	defer cancel()
+
+	start := time.Now()
+	err = p.Shutdown(ctx)
+	elapsed := time.Since(start)
+
+	if err != context.DeadlineExceeded {
+		t.Errorf("Shutdown err = %v, want context.DeadlineExceeded", err)
+	}
+	// Shutdown should return soon after ctxTimeout+grace, not hang
+	// indefinitely waiting on the stuck backend.
+	if max := ctxTimeout + grace + 5*time.Second; elapsed > max {
+		t.Errorf("Shutdown took %v, want less than %v", elapsed, max)
+	}
+	if got := p.ActiveConns(); got != 0 {
+		t.Errorf("ActiveConns() after Shutdown = %d, want 0", got)
+	}
+}
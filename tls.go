@@ -0,0 +1,168 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tcpproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"log"
+	"net"
+	"time"
+)
+
+// TLSTerminator is a Target that terminates TLS on the matched
+// connection and hands the decrypted stream to an inner Target.
+//
+// SNI routes on their own pass the encrypted bytes through untouched;
+// TLSTerminator lets callers terminate TLS at the proxy instead, and
+// re-route the plaintext (e.g. to an HTTP host router, or to another
+// DialProxy to re-encrypt upstream via TLSOriginator).
+type TLSTerminator struct {
+	// Config is the *tls.Config used for the handshake.
+	Config *tls.Config
+
+	// GetCertificate, if non-nil, overrides Config.GetCertificate
+	// for this TLSTerminator's handshakes. It's pluggable with
+	// golang.org/x/crypto/acme/autocert's Manager.GetCertificate,
+	// the same way it would be on an http.Server's TLSConfig.
+	GetCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+
+	// Target is where the decrypted connection is sent once the
+	// TLS handshake completes.
+	Target Target
+
+	// ShutdownGracePeriod is how long a connection stalled mid-
+	// handshake is given to finish on its own once its Proxy's
+	// Shutdown deadline expires, before the handshake is forced to
+	// fail. If zero, a default is used.
+	ShutdownGracePeriod time.Duration
+
+	// shutdownc is set by addRoute to the owning Proxy's shutdown
+	// channel. It's nil when used directly as a Target without
+	// going through a Proxy.
+	shutdownc <-chan struct{}
+}
+
+func (t *TLSTerminator) HandleConn(c net.Conn, rawConn net.Conn) {
+	if t.shutdownc != nil {
+		// Handshake blocks below, before Target is ever reached, so
+		// a connection stalled mid-handshake needs its own deadline
+		// set when shutdown fires; once the handshake has finished,
+		// setShutdownC has already wired the inner Target to do the
+		// same for whatever it does with tc.
+		stop := make(chan struct{})
+		defer close(stop)
+		go awaitShutdown(t.shutdownc, stop, t.shutdownGracePeriod(), c)
+	}
+	tc := tls.Server(c, t.config())
+	if err := tc.Handshake(); err != nil {
+		log.Printf("tcpproxy: TLS handshake from %v failed: %v", c.RemoteAddr(), err)
+		c.Close()
+		return
+	}
+	// tc, not rawConn, is the "raw" connection from here on: once
+	// TLS has transformed the byte stream, rawConn (the still-
+	// encrypted socket) and c no longer carry the same bytes, so
+	// nothing downstream may read from it.
+	t.Target.HandleConn(tc, tc)
+}
+
+func (t *TLSTerminator) shutdownGracePeriod() time.Duration {
+	if t.ShutdownGracePeriod > 0 {
+		return t.ShutdownGracePeriod
+	}
+	return 5 * time.Second
+}
+
+func (t *TLSTerminator) config() *tls.Config {
+	cfg := t.Config
+	if cfg == nil {
+		cfg = &tls.Config{}
+	}
+	if t.GetCertificate != nil {
+		cfg = cfg.Clone()
+		cfg.GetCertificate = t.GetCertificate
+	}
+	return cfg
+}
+
+func (t *TLSTerminator) setHooks(h *Hooks) {
+	if ht, ok := t.Target.(hookTarget); ok {
+		ht.setHooks(h)
+	}
+}
+
+func (t *TLSTerminator) setShutdownC(c <-chan struct{}) {
+	t.shutdownc = c
+	if st, ok := t.Target.(shutdownTarget); ok {
+		st.setShutdownC(c)
+	}
+}
+
+// TLSOriginator is a Target that wraps DialProxy's upstream leg in
+// TLS, so a TLS-speaking backend can be dialed directly from a plain
+// TCP route - including from a TLSTerminator's inner Target, for
+// TLS-to-TLS proxying with a different cert or SNI upstream.
+type TLSOriginator struct {
+	// DialProxy is the underlying dialer. Its Addr, DialTimeout,
+	// DialContext, KeepAlivePeriod, etc. all behave as they would
+	// on a plain DialProxy; TLSOriginator wraps the connection it
+	// dials in TLS before DialProxy starts copying bytes.
+	DialProxy *DialProxy
+
+	// Config is the *tls.Config used for the upstream handshake.
+	// If nil, an empty *tls.Config is used.
+	Config *tls.Config
+
+	// ServerName, if non-empty, overrides Config.ServerName as the
+	// SNI sent upstream. This is useful when re-encrypting to a
+	// backend whose certificate doesn't match the hostname the
+	// original client connected with.
+	ServerName string
+}
+
+func (t *TLSOriginator) HandleConn(src net.Conn, rawSrc net.Conn) {
+	dial := t.DialProxy.dialContext()
+	cfg := t.config()
+	dp := *t.DialProxy
+	dp.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		c, err := dial(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		tc := tls.Client(c, cfg)
+		if err := tc.HandshakeContext(ctx); err != nil {
+			c.Close()
+			return nil, err
+		}
+		return tc, nil
+	}
+	dp.HandleConn(src, rawSrc)
+}
+
+func (t *TLSOriginator) config() *tls.Config {
+	cfg := t.Config
+	if cfg == nil {
+		cfg = &tls.Config{}
+	} else {
+		cfg = cfg.Clone()
+	}
+	if t.ServerName != "" {
+		cfg.ServerName = t.ServerName
+	} else if cfg.ServerName == "" {
+		if host, _, err := net.SplitHostPort(t.DialProxy.Addr); err == nil {
+			cfg.ServerName = host
+		}
+	}
+	return cfg
+}
+
+func (t *TLSOriginator) setHooks(h *Hooks) {
+	t.DialProxy.setHooks(h)
+}
+
+func (t *TLSOriginator) setShutdownC(c <-chan struct{}) {
+	t.DialProxy.setShutdownC(c)
+}
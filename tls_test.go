@@ -0,0 +1,189 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tcpproxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// generateSelfSignedCert returns a minimal self-signed certificate
+// usable as a tls.Config's sole certificate in tests. Since tests
+// dial with InsecureSkipVerify, the cert need not carry a matching
+// SAN for the dialed address.
+func generateSelfSignedCert(t *testing.T) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "tcpproxy test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// TestTLSTerminator verifies that a TLSTerminator completes a TLS
+// handshake with a connecting client and hands the decrypted stream
+// to its inner Target.
+func TestTLSTerminator(t *testing.T) {
+	const request = "request"
+	const response = "response"
+	backendLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backendLn.Close()
+	backendErrc := make(chan error, 1)
+	go func() {
+		c, err := backendLn.Accept()
+		if err != nil {
+			backendErrc <- err
+			return
+		}
+		defer c.Close()
+		req := make([]byte, len(request))
+		if _, err := io.ReadFull(c, req); err != nil {
+			backendErrc <- err
+			return
+		}
+		if string(req) != request {
+			backendErrc <- fmt.Errorf("backend read request %q, want %q", req, request)
+			return
+		}
+		_, err = io.WriteString(c, response)
+		backendErrc <- err
+	}()
+
+	cert := generateSelfSignedCert(t)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	var p Proxy
+	p.ListenFunc = func(string, string) (net.Listener, error) { return ln, nil }
+	p.AddRoute(ln.Addr().String(), &TLSTerminator{
+		Config: &tls.Config{Certificates: []tls.Certificate{cert}},
+		Target: To(backendLn.Addr().String()),
+	})
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	rawConn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rawConn.Close()
+	conn := tls.Client(rawConn, &tls.Config{InsecureSkipVerify: true})
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := conn.Handshake(); err != nil {
+		t.Fatalf("client TLS handshake: %v", err)
+	}
+	if _, err := io.WriteString(conn, request); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(response))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != response {
+		t.Errorf("got response %q, want %q", got, response)
+	}
+	if err := <-backendErrc; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestTLSOriginator verifies that a TLSOriginator re-encrypts the
+// connection it dials upstream, against a backend that requires TLS.
+func TestTLSOriginator(t *testing.T) {
+	const request = "request"
+	const response = "response"
+	cert := generateSelfSignedCert(t)
+	backendLn, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backendLn.Close()
+	backendErrc := make(chan error, 1)
+	go func() {
+		c, err := backendLn.Accept()
+		if err != nil {
+			backendErrc <- err
+			return
+		}
+		defer c.Close()
+		req := make([]byte, len(request))
+		if _, err := io.ReadFull(c, req); err != nil {
+			backendErrc <- err
+			return
+		}
+		if string(req) != request {
+			backendErrc <- fmt.Errorf("backend read request %q, want %q", req, request)
+			return
+		}
+		_, err = io.WriteString(c, response)
+		backendErrc <- err
+	}()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	var p Proxy
+	p.ListenFunc = func(string, string) (net.Listener, error) { return ln, nil }
+	p.AddRoute(ln.Addr().String(), &TLSOriginator{
+		DialProxy: &DialProxy{Addr: backendLn.Addr().String()},
+		Config:    &tls.Config{InsecureSkipVerify: true},
+	})
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := io.WriteString(conn, request); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(response))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != response {
+		t.Errorf("got response %q, want %q", got, response)
+	}
+	if err := <-backendErrc; err != nil {
+		t.Fatal(err)
+	}
+}